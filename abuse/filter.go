@@ -0,0 +1,103 @@
+// Package abuse implements a Bloom-filter-backed guard used to recognize
+// previously-seen abusive signals (email addresses, IP addresses, payment
+// fingerprints) so that signup and support can react to repeat offenders
+// without keeping an ever-growing exact set in memory.
+package abuse
+
+import "hash/fnv"
+import "math"
+import "sync"
+
+// Filter is a standard Bloom filter: a bitset of m bits addressed by k
+// independent hash functions, derived here via double hashing so that only
+// a single fast hash needs to be computed per Add/Test call.
+type Filter struct {
+	mu sync.RWMutex
+	bits []bool
+	m uint64
+	k uint64
+}
+
+// NewFilter sizes a filter for expectedItems entries at the given target
+// false positive rate, using the standard formulas
+// m = -n*ln(p)/(ln(2)^2) and k = (m/n)*ln(2).
+func NewFilter(expectedItems uint, fpr float64) *Filter {
+	n := float64(expectedItems)
+	m := math.Ceil(-n * math.Log(fpr) / (math.Ln2 * math.Ln2))
+	k := math.Ceil((m / n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+
+	return &Filter{
+		bits: make([]bool, uint64(m)),
+		m: uint64(m),
+		k: uint64(k),
+	}
+}
+
+// Add records a signal as having been seen.
+func (f *Filter) Add(signal string) {
+	h1, h2 := f.hashes(signal)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := uint64(0); i < f.k; i++ {
+		f.bits[f.position(h1, h2, i)] = true
+	}
+}
+
+// Test reports whether the signal has probably been seen before. As with
+// any Bloom filter, false positives are possible but false negatives are
+// not: a false result means the signal is definitely new.
+func (f *Filter) Test(signal string) bool {
+	h1, h2 := f.hashes(signal)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i := uint64(0); i < f.k; i++ {
+		if !f.bits[f.position(h1, h2, i)] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Filter) position(h1 uint64, h2 uint64, i uint64) uint64 {
+	return (h1 + i*h2) % f.m
+}
+
+// hashes derives two independent 64-bit hashes from a single FNV-1a pass by
+// splitting the 128-bit digest in half, avoiding a second hash computation
+// per lookup.
+func (f *Filter) hashes(signal string) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write([]byte(signal))
+	sum := h.Sum(nil)
+
+	h1 := uint64(0)
+	h2 := uint64(0)
+	for i := 0; i < 8; i++ {
+		h1 = h1<<8 | uint64(sum[i])
+		h2 = h2<<8 | uint64(sum[i+8])
+	}
+	return h1, h2
+}
+
+// Bits returns a copy of the underlying bitset, e.g. for persistence.
+func (f *Filter) Bits() []bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make([]bool, len(f.bits))
+	copy(out, f.bits)
+	return out
+}
+
+// LoadBits restores a previously-persisted bitset. The length must match
+// the filter's m; callers should construct the Filter with the same
+// expectedItems/fpr used when it was originally saved.
+func (f *Filter) LoadBits(bits []bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	copy(f.bits, bits)
+}
@@ -0,0 +1,69 @@
+package abuse
+
+import "fmt"
+import "testing"
+
+func TestFilterAddThenTest(t *testing.T) {
+	f := NewFilter(1000, 0.01)
+	f.Add("email:abuser@example.com")
+
+	if !f.Test("email:abuser@example.com") {
+		t.Fatal("expected a signal that was added to test positive")
+	}
+	if f.Test("email:innocent@example.com") {
+		t.Fatal("did not expect an unrelated signal to test positive")
+	}
+}
+
+func TestFilterNeverFalseNegative(t *testing.T) {
+	f := NewFilter(500, 0.01)
+	signals := make([]string, 0, 500)
+	for i := 0; i < 500; i++ {
+		signal := fmt.Sprintf("ip:10.0.0.%d", i)
+		f.Add(signal)
+		signals = append(signals, signal)
+	}
+
+	for _, signal := range signals {
+		if !f.Test(signal) {
+			t.Fatalf("bloom filters must not have false negatives, but %q tested negative after being added", signal)
+		}
+	}
+}
+
+func TestFilterFalsePositiveRateIsRoughlyBounded(t *testing.T) {
+	const n = 2000
+	const fpr = 0.01
+
+	f := NewFilter(n, fpr)
+	for i := 0; i < n; i++ {
+		f.Add(fmt.Sprintf("email:user%d@example.com", i))
+	}
+
+	falsePositives := 0
+	trials := 10000
+	for i := 0; i < trials; i++ {
+		if f.Test(fmt.Sprintf("email:absent%d@example.com", i)) {
+			falsePositives++
+		}
+	}
+
+	// generous slack over the target rate since this is a statistical
+	// property, not an exact bound
+	observed := float64(falsePositives) / float64(trials)
+	if observed > fpr*3 {
+		t.Fatalf("observed false positive rate %.4f is far above the target %.4f", observed, fpr)
+	}
+}
+
+func TestFilterBitsRoundTrip(t *testing.T) {
+	f := NewFilter(100, 0.01)
+	f.Add("payment:fingerprint-1")
+
+	other := NewFilter(100, 0.01)
+	other.LoadBits(f.Bits())
+
+	if !other.Test("payment:fingerprint-1") {
+		t.Fatal("expected a filter restored from persisted bits to retain previously-added signals")
+	}
+}
@@ -0,0 +1,275 @@
+package lobster
+
+import "errors"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "sync"
+import "time"
+
+import "github.com/gorilla/websocket"
+
+// errConsoleDeadlineExceeded signals that a read/write hit its deadline
+// rather than encountering a real I/O error; callers should retry rather
+// than tear down the connection, since an idle console (e.g. sitting at a
+// login prompt) is expected to hit this regularly.
+var errConsoleDeadlineExceeded = errors.New("console: deadline exceeded")
+
+// VMIConsole is an optional VmInterface extension for backends that can
+// hand out a short-lived console (VNC or serial) endpoint for a VM.
+type VMIConsole interface {
+	// GetConsoleEndpoint returns the host to dial and a one-time token
+	// authorizing access to it.
+	GetConsoleEndpoint(vmId int) (host string, token string, err error)
+}
+
+// deadlineTimer implements the read/write deadline handling used by
+// ConsoleProxy, mirroring the pattern used by netstack's gonet adapter:
+// SetDeadline stops any pending timer, resets the cancel channel, and if a
+// non-zero time is given schedules the channel to be closed when it elapses.
+type deadlineTimer struct {
+	mu sync.Mutex
+	timer *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadlineTimer() *deadlineTimer {
+	return &deadlineTimer{cancel: make(chan struct{})}
+}
+
+func (d *deadlineTimer) SetDeadline(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.cancel = make(chan struct{})
+
+	if !t.IsZero() {
+		cancel := d.cancel
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			close(cancel)
+		})
+	}
+}
+
+func (d *deadlineTimer) done() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// ConsoleProxy tunnels raw bytes between a VM's VNC/serial console and a
+// browser-side WebSocket, so that users can reach the console through the
+// Lobster web frontend without exposing the hypervisor network directly.
+type ConsoleProxy struct {
+	Lobster *Lobster
+}
+
+func MakeConsoleProxy(app *Lobster) *ConsoleProxy {
+	return &ConsoleProxy{
+		Lobster: app,
+	}
+}
+
+// ConsoleHandler is meant to be wired into the HTTP router as the endpoint
+// that upgrades to a WebSocket and proxies to the VM's console once
+// ownership has been verified, the same way StripePayment.Callback and
+// friends are wired in by the payment router.
+func (this *ConsoleProxy) ConsoleHandler(w http.ResponseWriter, r *http.Request, userId int, vmId int) {
+	vm := vmGet(userId, vmId)
+	if vm == nil {
+		http.Error(w, "no such virtual machine", http.StatusNotFound)
+		return
+	}
+
+	region, ok := regionInterfaces[vm.Region]
+	if !ok {
+		http.Error(w, "region unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	vmiConsole, ok := region.(VMIConsole)
+	if !ok {
+		http.Error(w, "console not supported for this region", http.StatusNotImplemented)
+		return
+	}
+
+	host, token, err := vmiConsole.GetConsoleEndpoint(vmId)
+	if err != nil {
+		log.Printf("console: failed to get console endpoint for vm %d: %s", vmId, err.Error())
+		http.Error(w, "failed to open console", http.StatusBadGateway)
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("console: websocket upgrade failed: %s", err.Error())
+		return
+	}
+	defer ws.Close()
+
+	conn, err := this.dial(host, token)
+	if err != nil {
+		log.Printf("console: failed to dial console host %s: %s", host, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	this.pump(ws, conn)
+}
+
+// pump shuttles bytes in both directions until either side closes or a
+// deadline elapses. Reads and writes each go through their own consoleIo,
+// which keeps at most one operation in flight per direction, so that
+// retrying after a deadline waits on the I/O already in flight instead of
+// starting a second one over the same connection and buffer.
+//
+// The two directions don't notice each other's errors on their own: an
+// idle console never produces data for ws.WriteMessage to fail on, and an
+// idle browser never sends a message for writer.write to fail on. So
+// closeBoth is called from both sides the moment either one ends, closing
+// conn and ws so that whichever side is still blocked in a read unblocks
+// immediately instead of waiting out deadlines that, for an idle
+// connection, may never come.
+func (this *ConsoleProxy) pump(ws *websocket.Conn, conn io.ReadWriteCloser) {
+	reader := makeConsoleIo()
+	writer := makeConsoleIo()
+	done := make(chan struct{})
+
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			conn.Close()
+			ws.Close()
+		})
+	}
+
+	go func() {
+		defer close(done)
+		defer closeBoth()
+		for {
+			data, err := reader.read(conn)
+			if err == errConsoleDeadlineExceeded {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		}
+	}()
+
+readLoop:
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		for {
+			err := writer.write(conn, message)
+			if err == errConsoleDeadlineExceeded {
+				continue
+			}
+			if err != nil {
+				break readLoop
+			}
+			break
+		}
+	}
+	closeBoth()
+
+	<-done
+}
+
+// consoleIo serializes a stream of deadline-bounded reads or writes for one
+// direction: each operation runs on a background goroutine of its own, and a
+// new one is only started once the previous one has returned, so that a
+// call which times out and is retried observes the same pending operation
+// rather than racing a fresh one against it.
+type consoleIo struct {
+	deadline *deadlineTimer
+	pending chan consoleIoResult
+	inFlight bool
+}
+
+type consoleIoResult struct {
+	data []byte
+	err error
+}
+
+func makeConsoleIo() *consoleIo {
+	return &consoleIo{
+		deadline: makeDeadlineTimer(),
+		pending: make(chan consoleIoResult, 1),
+	}
+}
+
+func (c *consoleIo) read(conn io.Reader) ([]byte, error) {
+	if !c.inFlight {
+		c.inFlight = true
+		go func() {
+			buf := make([]byte, 4096)
+			n, err := conn.Read(buf)
+			c.pending <- consoleIoResult{data: buf[:n], err: err}
+		}()
+	}
+
+	c.deadline.SetDeadline(time.Now().Add(60 * time.Second))
+	select {
+	case r := <-c.pending:
+		c.inFlight = false
+		return r.data, r.err
+	case <-c.deadline.done():
+		return nil, errConsoleDeadlineExceeded
+	}
+}
+
+// write sends data, or, if a write is already in flight from a prior
+// deadline timeout, waits on that one instead; callers retry with the same
+// data until it succeeds, so the in-flight write is always for this data.
+func (c *consoleIo) write(conn io.Writer, data []byte) error {
+	if !c.inFlight {
+		c.inFlight = true
+		go func() {
+			_, err := conn.Write(data)
+			c.pending <- consoleIoResult{err: err}
+		}()
+	}
+
+	c.deadline.SetDeadline(time.Now().Add(60 * time.Second))
+	select {
+	case r := <-c.pending:
+		c.inFlight = false
+		return r.err
+	case <-c.deadline.done():
+		return errConsoleDeadlineExceeded
+	}
+}
+
+// dialTimeout bounds how long dial() waits to establish the TCP connection
+// to the console host before giving up.
+const dialTimeout = 10 * time.Second
+
+// dial opens a TCP connection to the console host handed out by
+// GetConsoleEndpoint and presents the one-time token as a newline-terminated
+// auth line, matching the handshake used by token-gated VNC/serial relays
+// (e.g. websockify's token-plugin mode): the relay reads the line itself
+// before treating the rest of the connection as the raw console stream.
+func (this *ConsoleProxy) dial(host string, token string) (io.ReadWriteCloser, error) {
+	conn, err := net.DialTimeout("tcp", host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte(token + "\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
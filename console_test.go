@@ -0,0 +1,45 @@
+package lobster
+
+import "testing"
+import "time"
+
+func TestDeadlineTimerZeroNeverFires(t *testing.T) {
+	d := makeDeadlineTimer()
+	d.SetDeadline(time.Time{})
+
+	select {
+	case <-d.done():
+		t.Fatal("zero deadline should never close the cancel channel")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDeadlineTimerFiresAfterElapsed(t *testing.T) {
+	d := makeDeadlineTimer()
+	d.SetDeadline(time.Now().Add(10 * time.Millisecond))
+
+	select {
+	case <-d.done():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("expected the cancel channel to close once the deadline elapsed")
+	}
+}
+
+func TestDeadlineTimerResetReplacesChannel(t *testing.T) {
+	d := makeDeadlineTimer()
+	d.SetDeadline(time.Now().Add(time.Hour))
+	first := d.done()
+
+	d.SetDeadline(time.Now().Add(time.Hour))
+	second := d.done()
+
+	if first == second {
+		t.Fatal("expected SetDeadline to install a fresh cancel channel")
+	}
+
+	select {
+	case <-second:
+		t.Fatal("the reset deadline fired well before its new, far-future expiry")
+	default:
+	}
+}
@@ -42,7 +42,7 @@ type VmConfig struct {
 type PaymentConfig struct {
 	Name string `json:"name"`
 
-	// one of paypal, coinbase, fake
+	// one of paypal, coinbase, stripe, bitcoinrpc, fake
 	Type string `json:"type"`
 
 	// paypal options
@@ -52,9 +52,18 @@ type PaymentConfig struct {
 	// coinbase options
 	CallbackSecret string `json:"callback_secret"`
 
-	// API options (used by coinbase)
+	// API options (used by coinbase, stripe)
 	ApiKey string `json:"api_key"`
 	ApiSecret string `json:"api_secret"`
+
+	// stripe options
+	WebhookSecret string `json:"webhook_secret"`
+
+	// bitcoinrpc options
+	RpcUrl string `json:"rpc_url"`
+	RpcUser string `json:"rpc_user"`
+	RpcPass string `json:"rpc_pass"`
+	Confirmations int `json:"confirmations"`
 }
 
 type InterfaceConfig struct {
@@ -69,6 +78,8 @@ func main() {
 	}
 	app := lobster.MakeLobster(cfgPath)
 	app.Init()
+	lobster.AbuseGuardInit()
+	lobster.TicketWorkflowInit()
 
 	// load interface configuration
 	interfacePath := cfgPath + ".json"
@@ -114,6 +125,10 @@ func main() {
 			pi = lobster.MakePaypalPayment(app, payment.Business, payment.ReturnUrl)
 		} else if payment.Type == "coinbase" {
 			pi = lobster.MakeCoinbasePayment(app, payment.CallbackSecret, payment.ApiKey, payment.ApiSecret)
+		} else if payment.Type == "stripe" {
+			pi = lobster.MakeStripePayment(app, payment.ApiKey, payment.WebhookSecret)
+		} else if payment.Type == "bitcoinrpc" {
+			pi = lobster.MakeBitcoinRpcPayment(app, payment.RpcUrl, payment.RpcUser, payment.RpcPass, payment.Confirmations)
 		} else if payment.Type == "fake" {
 			pi = new(lobster.FakePayment)
 		} else {
@@ -0,0 +1,227 @@
+package lobster
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "log"
+import "net/http"
+import "net/url"
+import "strconv"
+import "strings"
+import "time"
+
+// stripeWebhookTolerance bounds how old a signed webhook timestamp may be
+// before we treat it as a replay rather than a live delivery; this mirrors
+// Stripe's own library default.
+const stripeWebhookTolerance = 5 * time.Minute
+
+// Migration: stripe_events records the id of every checkout.session.completed
+// webhook we've acted on, since Stripe delivers webhooks at-least-once and
+// retries on anything but a 2xx; without this a retried delivery would
+// credit the same checkout session twice.
+//
+//   CREATE TABLE stripe_events (
+//       event_id VARCHAR(64) NOT NULL,
+//       time DATETIME NOT NULL,
+//       PRIMARY KEY (event_id)
+//   );
+
+// StripePayment implements PaymentInterface using Stripe Checkout Sessions.
+// Successful checkouts are confirmed asynchronously via the
+// checkout.session.completed webhook rather than the redirect back to us,
+// since the redirect is not authenticated.
+type StripePayment struct {
+	Lobster *Lobster
+	ApiKey string
+	WebhookSecret string
+}
+
+func MakeStripePayment(app *Lobster, apiKey string, webhookSecret string) *StripePayment {
+	return &StripePayment{
+		Lobster: app,
+		ApiKey: apiKey,
+		WebhookSecret: webhookSecret,
+	}
+}
+
+func (this *StripePayment) Name() string {
+	return "Stripe"
+}
+
+// Payment creates a Stripe Checkout Session for the given user and amount
+// (in cents, as returned by planPriceFor) and redirects the user to
+// Stripe's hosted checkout page.
+func (this *StripePayment) Payment(w http.ResponseWriter, r *http.Request, userId int, amount int64) error {
+	params := map[string]string{
+		"mode": "payment",
+		"success_url": cfg.Default.BaseUrl + "/billing?stripe=success",
+		"cancel_url": cfg.Default.BaseUrl + "/billing?stripe=cancel",
+		"client_reference_id": fmt.Sprintf("%d", userId),
+		"line_items[0][price_data][currency]": "usd",
+		"line_items[0][price_data][product_data][name]": "Account credit",
+		"line_items[0][price_data][unit_amount]": fmt.Sprintf("%d", amount),
+		"line_items[0][quantity]": "1",
+	}
+
+	session, err := this.apiRequest("POST", "checkout/sessions", params)
+	if err != nil {
+		return err
+	}
+
+	url, ok := session["url"].(string)
+	if !ok {
+		return L.Error("payment_provider_error")
+	}
+
+	http.Redirect(w, r, url, http.StatusSeeOther)
+	return nil
+}
+
+// Callback handles the Stripe webhook, verifying the Stripe-Signature header
+// (an HMAC-SHA256 over "timestamp.body" keyed by the webhook secret) before
+// crediting the associated user account on checkout.session.completed.
+func (this *StripePayment) Callback(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("stripe: failed to read webhook body: %s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !this.verifySignature(r.Header.Get("Stripe-Signature"), body) {
+		log.Printf("stripe: webhook signature verification failed")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var event struct {
+		Id string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ClientReferenceId string `json:"client_reference_id"`
+				AmountTotal int64 `json:"amount_total"`
+				PaymentIntent string `json:"payment_intent"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		log.Printf("stripe: failed to parse webhook payload: %s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if event.Type != "checkout.session.completed" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if event.Id == "" || !this.recordEvent(event.Id) {
+		// already processed this event id, or it's malformed; ack so
+		// Stripe stops retrying without crediting the user again
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var userId int
+	fmt.Sscanf(event.Data.Object.ClientReferenceId, "%d", &userId)
+	if userId == 0 {
+		log.Printf("stripe: webhook missing client_reference_id")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	usd := float64(event.Data.Object.AmountTotal) / 100
+	userTransactionAdd(userId, "Stripe", event.Data.Object.PaymentIntent, usd)
+	planCheckoutComplete(userId)
+	log.Printf("stripe: credited user %d with $%.2f (payment intent %s)", userId, usd, event.Data.Object.PaymentIntent)
+	w.WriteHeader(http.StatusOK)
+}
+
+// recordEvent inserts the event id into stripe_events and reports whether
+// this was the first time we've seen it. The insert's primary key conflict
+// is what makes the dedupe atomic against concurrent/retried deliveries: we
+// never check-then-insert, we just look at whether our own insert stuck.
+func (this *StripePayment) recordEvent(eventId string) bool {
+	result := db.Exec("INSERT IGNORE INTO stripe_events (event_id, time) VALUES (?, NOW())", eventId)
+	return result.RowsAffected() == 1
+}
+
+// verifySignature checks the Stripe-Signature header's HMAC-SHA256 over
+// "timestamp.body", and rejects signatures whose timestamp is older than
+// stripeWebhookTolerance so a captured request can't be replayed later.
+func (this *StripePayment) verifySignature(header string, body []byte) bool {
+	if header == "" || this.WebhookSecret == "" {
+		return false
+	}
+
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if kv[0] == "t" {
+			timestamp = kv[1]
+		} else if kv[0] == "v1" {
+			signature = kv[1]
+		}
+	}
+	if timestamp == "" || signature == "" {
+		return false
+	}
+
+	timestampSeconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(timestampSeconds, 0))
+	if age < 0 {
+		age = -age
+	}
+	if age > stripeWebhookTolerance {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(this.WebhookSecret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func (this *StripePayment) apiRequest(method string, path string, params map[string]string) (map[string]interface{}, error) {
+	form := url.Values{}
+	for k, v := range params {
+		form.Set(k, v)
+	}
+
+	req, err := http.NewRequest(method, "https://api.stripe.com/v1/"+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(this.ApiKey, "")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("stripe API request to %s failed with status %d: %s", path, resp.StatusCode, string(body))
+	}
+	return result, nil
+}
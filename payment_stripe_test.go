@@ -0,0 +1,57 @@
+package lobster
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "testing"
+import "time"
+
+func signStripePayload(secret string, timestamp int64, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%d.%s", timestamp, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestStripeVerifySignatureAccepts(t *testing.T) {
+	payment := &StripePayment{WebhookSecret: "whsec_test"}
+	body := `{"type":"checkout.session.completed"}`
+	timestamp := time.Now().Unix()
+	signature := signStripePayload(payment.WebhookSecret, timestamp, body)
+	header := fmt.Sprintf("t=%d,v1=%s", timestamp, signature)
+
+	if !payment.verifySignature(header, []byte(body)) {
+		t.Fatal("expected a freshly-signed payload with the correct secret to verify")
+	}
+}
+
+func TestStripeVerifySignatureRejectsWrongSecret(t *testing.T) {
+	payment := &StripePayment{WebhookSecret: "whsec_test"}
+	body := `{"type":"checkout.session.completed"}`
+	timestamp := time.Now().Unix()
+	signature := signStripePayload("whsec_other", timestamp, body)
+	header := fmt.Sprintf("t=%d,v1=%s", timestamp, signature)
+
+	if payment.verifySignature(header, []byte(body)) {
+		t.Fatal("expected a payload signed with the wrong secret to be rejected")
+	}
+}
+
+func TestStripeVerifySignatureRejectsStalePayload(t *testing.T) {
+	payment := &StripePayment{WebhookSecret: "whsec_test"}
+	body := `{"type":"checkout.session.completed"}`
+	timestamp := time.Now().Add(-1 * time.Hour).Unix()
+	signature := signStripePayload(payment.WebhookSecret, timestamp, body)
+	header := fmt.Sprintf("t=%d,v1=%s", timestamp, signature)
+
+	if payment.verifySignature(header, []byte(body)) {
+		t.Fatal("expected a correctly-signed but stale (replayed) payload to be rejected")
+	}
+}
+
+func TestStripeVerifySignatureRejectsMissingHeader(t *testing.T) {
+	payment := &StripePayment{WebhookSecret: "whsec_test"}
+	if payment.verifySignature("", []byte("{}")) {
+		t.Fatal("expected an empty signature header to be rejected")
+	}
+}
@@ -1,6 +1,7 @@
 package lobster
 
 import "fmt"
+import "log"
 
 type Plan struct {
 	Id        int
@@ -22,6 +23,23 @@ type Plan struct {
 
 	// loadable metadata (key-value pairs)
 	Metadata map[string]string
+
+	// loadable per-period prices; see plan_pricing.go
+	Prices map[string]int64
+}
+
+func (plan *Plan) LoadPrices() {
+	rows := db.Query("SELECT period, price FROM plan_prices WHERE plan_id = ?", plan.Id)
+	plan.Prices = make(map[string]int64)
+	for rows.Next() {
+		var period string
+		var price int64
+		rows.Scan(&period, &price)
+		plan.Prices[period] = price
+	}
+	if _, ok := plan.Prices[BillingPeriodMonthly]; !ok {
+		plan.Prices[BillingPeriodMonthly] = plan.Price
+	}
 }
 
 func (plan *Plan) LoadRegionPlans() {
@@ -165,6 +183,17 @@ func planDeassociateRegion(planId int, region string) {
 	db.Exec("DELETE FROM region_plans WHERE plan_id = ? AND region = ?", planId, region)
 }
 
+// planAutopopulate imports plans from the region's VMIPlans backend,
+// creating any that aren't already associated and reconciling the rest.
+// Metadata beyond the fixed RAM/CPU/Storage/Bandwidth columns (GPU count,
+// image restrictions, IPv6 availability, region tier, ...) is imported via
+// planSetMetadata whenever the backend's PlanList populates Plan.Metadata.
+// Populating Metadata is each backend's responsibility, not this function's
+// - solusvm, lndynamic, lobopenstack, and vmfake each need their own
+// PlanList to fill it in from whatever their provider API exposes. A
+// backend that leaves Metadata nil on every plan contributes none, and
+// planMetadataImportCheck logs that so it shows up as a visible gap rather
+// than a silent no-op.
 func planAutopopulate(region string) error {
 	if _, ok := regionInterfaces[region]; !ok {
 		return fmt.Errorf("specified region %s does not exist", region)
@@ -178,22 +207,101 @@ func planAutopopulate(region string) error {
 		return err
 	}
 
-	// add plans that aren't already having matching identification in database
+	// add plans that aren't already having matching identification in database;
+	// reconcile the rest so that upstream price/spec drift is reflected
+	withMetadata := 0
 	for _, plan := range plans {
-		var count int
-		db.QueryRow(
-			"SELECT COUNT(*) FROM region_plans WHERE region = ? AND identification = ?",
+		var planId int
+		err := db.QueryRow(
+			"SELECT plan_id FROM region_plans WHERE region = ? AND identification = ?",
 			region, plan.Identification,
-		).Scan(&count)
-		if count == 0 {
-			planId := planCreate(plan.Name, plan.Price, plan.Ram, plan.Cpu, plan.Storage, plan.Bandwidth, false)
+		).Scan(&planId)
+		if err != nil {
+			planId = planCreate(plan.Name, plan.Price, plan.Ram, plan.Cpu, plan.Storage, plan.Bandwidth, false)
 			planAssociateRegion(planId, region, plan.Identification)
+		} else {
+			planReconcileOne(planId, plan)
+		}
+
+		if planImportMetadata(planId, plan) {
+			withMetadata++
+		}
+	}
+	planMetadataImportCheck(region, len(plans), withMetadata)
+
+	return nil
+}
+
+// planReconcile refreshes the price/specs (and, where the backend's
+// PlanList populates Plan.Metadata, the metadata) of all plans associated
+// with the given region against the provider's current plan listing,
+// without inserting any plans that aren't already known.
+func planReconcile(region string) error {
+	if _, ok := regionInterfaces[region]; !ok {
+		return fmt.Errorf("specified region %s does not exist", region)
+	}
+	vmi, ok := regionInterfaces[region].(VMIPlans)
+	if !ok {
+		return L.Error("region_plans_unsupported")
+	}
+	plans, err := vmi.PlanList()
+	if err != nil {
+		return err
+	}
+
+	considered := 0
+	withMetadata := 0
+	for _, plan := range plans {
+		var planId int
+		err := db.QueryRow(
+			"SELECT plan_id FROM region_plans WHERE region = ? AND identification = ?",
+			region, plan.Identification,
+		).Scan(&planId)
+		if err != nil {
+			continue
+		}
+		planReconcileOne(planId, plan)
+		considered++
+		if planImportMetadata(planId, plan) {
+			withMetadata++
 		}
 	}
+	planMetadataImportCheck(region, considered, withMetadata)
 
 	return nil
 }
 
+// planImportMetadata persists a backend-supplied plan's metadata, if any,
+// and reports whether it had any to persist.
+func planImportMetadata(planId int, plan *Plan) bool {
+	for k, v := range plan.Metadata {
+		planSetMetadata(planId, k, v)
+	}
+	return len(plan.Metadata) > 0
+}
+
+// planMetadataImportCheck surfaces a region backend that never populates
+// Plan.Metadata, so the metadata-import feature being inert for a given
+// region is a line in the log rather than something only discovered by
+// reading the backend's source. total counts only plans that were actually
+// reconciled/created, not ones skipped for other reasons (e.g.
+// planReconcile ignoring plans it doesn't recognize yet), so a region that
+// simply has nothing to import yet doesn't get misreported as a backend
+// that never populates metadata.
+func planMetadataImportCheck(region string, total int, withMetadata int) {
+	if total > 0 && withMetadata == 0 {
+		log.Printf("plan: region %s backend returned %d plan(s) with no metadata on any of them; "+
+			"its VMIPlans.PlanList does not populate Plan.Metadata", region, total)
+	}
+}
+
+func planReconcileOne(planId int, plan *Plan) {
+	db.Exec(
+		"UPDATE plans SET name = ?, price = ?, ram = ?, cpu = ?, storage = ?, bandwidth = ? WHERE id = ?",
+		plan.Name, plan.Price, plan.Ram, plan.Cpu, plan.Storage, plan.Bandwidth, planId,
+	)
+}
+
 func planSetMetadata(planId int, k string, v string) {
 	var count int
 	db.QueryRow("SELECT COUNT(*) FROM plan_metadata WHERE plan_id = ? AND k = ?", planId, k).Scan(&count)
@@ -0,0 +1,278 @@
+package lobster
+
+import "log"
+import "net/http"
+import "time"
+
+// Migration: plan_prices lets a plan have a distinct price per billing
+// period instead of the single monthly Price column; promo_codes and
+// promo_code_redemptions back planPriceFor's discount handling.
+//
+//   CREATE TABLE plan_prices (
+//       plan_id INT NOT NULL,
+//       period VARCHAR(16) NOT NULL,
+//       price BIGINT NOT NULL,
+//       PRIMARY KEY (plan_id, period)
+//   );
+//   CREATE TABLE promo_codes (
+//       id INT NOT NULL AUTO_INCREMENT,
+//       code VARCHAR(32) NOT NULL,
+//       percent_off INT NOT NULL DEFAULT 0,
+//       amount_off BIGINT NOT NULL DEFAULT 0,
+//       plan_id INT NULL,
+//       max_uses INT NOT NULL DEFAULT 0,
+//       remaining_uses INT NOT NULL DEFAULT 0,
+//       expire_time DATETIME NULL,
+//       revoked BOOLEAN NOT NULL DEFAULT 0,
+//       PRIMARY KEY (id),
+//       UNIQUE KEY (code)
+//   );
+//   CREATE TABLE promo_code_redemptions (
+//       promo_code_id INT NOT NULL,
+//       user_id INT NOT NULL,
+//       time DATETIME NOT NULL,
+//       PRIMARY KEY (promo_code_id, user_id)
+//   );
+//   CREATE TABLE pending_checkouts (
+//       id INT NOT NULL AUTO_INCREMENT,
+//       user_id INT NOT NULL,
+//       promo_code VARCHAR(32) NOT NULL,
+//       time DATETIME NOT NULL,
+//       PRIMARY KEY (id),
+//       KEY (user_id)
+//   );
+
+const (
+	BillingPeriodHourly = "hourly"
+	BillingPeriodMonthly = "monthly"
+	BillingPeriodYearly = "yearly"
+)
+
+type PromoCode struct {
+	Id int
+	Code string
+	PercentOff int
+	AmountOff int64
+	PlanId int
+	MaxUses int
+	RemainingUses int
+	ExpireTime time.Time
+	Revoked bool
+}
+
+func planSetPrice(planId int, period string, price int64) {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM plan_prices WHERE plan_id = ? AND period = ?", planId, period).Scan(&count)
+	if count == 1 {
+		db.Exec("UPDATE plan_prices SET price = ? WHERE plan_id = ? AND period = ?", price, planId, period)
+	} else {
+		db.Exec("INSERT INTO plan_prices (plan_id, period, price) VALUES (?, ?, ?)", planId, period, price)
+	}
+	if period == BillingPeriodMonthly {
+		db.Exec("UPDATE plans SET price = ? WHERE id = ?", price, planId)
+	}
+}
+
+func planUnsetPrice(planId int, period string) {
+	db.Exec("DELETE FROM plan_prices WHERE plan_id = ? AND period = ?", planId, period)
+}
+
+func promoCodeList() []*PromoCode {
+	rows := db.Query("SELECT id, code, percent_off, amount_off, IFNULL(plan_id, 0), max_uses, remaining_uses, expire_time, revoked FROM promo_codes ORDER BY code")
+	defer rows.Close()
+	codes := make([]*PromoCode, 0)
+	for rows.Next() {
+		p := &PromoCode{}
+		rows.Scan(&p.Id, &p.Code, &p.PercentOff, &p.AmountOff, &p.PlanId, &p.MaxUses, &p.RemainingUses, &p.ExpireTime, &p.Revoked)
+		codes = append(codes, p)
+	}
+	return codes
+}
+
+func promoCodeGet(code string) *PromoCode {
+	p := &PromoCode{}
+	err := db.QueryRow(
+		"SELECT id, code, percent_off, amount_off, IFNULL(plan_id, 0), max_uses, remaining_uses, expire_time, revoked "+
+			"FROM promo_codes WHERE code = ?",
+		code,
+	).Scan(&p.Id, &p.Code, &p.PercentOff, &p.AmountOff, &p.PlanId, &p.MaxUses, &p.RemainingUses, &p.ExpireTime, &p.Revoked)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+func promoCodeCreate(code string, percentOff int, amountOff int64, planId int, maxUses int, expireTime time.Time) int {
+	result := db.Exec(
+		"INSERT INTO promo_codes (code, percent_off, amount_off, plan_id, max_uses, remaining_uses, expire_time) "+
+			"VALUES (?, ?, ?, NULLIF(?, 0), ?, ?, ?)",
+		code, percentOff, amountOff, planId, maxUses, maxUses, expireTime,
+	)
+	return result.LastInsertId()
+}
+
+func promoCodeRevoke(promoCodeId int) {
+	db.Exec("UPDATE promo_codes SET revoked = 1 WHERE id = ?", promoCodeId)
+}
+
+// promoCodeRedeem atomically decrements a promo code's remaining uses.
+//
+// The "already redeemed by this user" check and the reservation of a slot
+// for that user are the same statement: an INSERT ... SELECT gated on
+// promo_code_redemptions' primary key (promo_code_id, user_id), which the
+// database enforces atomically across concurrent callers, unlike a
+// separate SELECT COUNT(*) followed by a conditional UPDATE. Only once
+// that reservation succeeds do we decrement remaining_uses, itself guarded
+// by a row-level WHERE remaining_uses > 0 so the pool can't go negative; if
+// the pool turned out to be exhausted by a concurrent redemption we release
+// the reservation.
+func promoCodeRedeem(promoCodeId int, userId int) error {
+	reserved := db.Exec(
+		"INSERT INTO promo_code_redemptions (promo_code_id, user_id, time) "+
+			"SELECT ?, ?, NOW() FROM promo_codes "+
+			"WHERE id = ? AND revoked = 0 "+
+			"AND NOT EXISTS (SELECT 1 FROM promo_code_redemptions WHERE promo_code_id = ? AND user_id = ?)",
+		promoCodeId, userId, promoCodeId, promoCodeId, userId,
+	)
+	if reserved.RowsAffected() == 0 {
+		return L.Error("promo_code_already_used")
+	}
+
+	decremented := db.Exec(
+		"UPDATE promo_codes SET remaining_uses = remaining_uses - 1 WHERE id = ? AND remaining_uses > 0",
+		promoCodeId,
+	)
+	if decremented.RowsAffected() == 0 {
+		db.Exec("DELETE FROM promo_code_redemptions WHERE promo_code_id = ? AND user_id = ?", promoCodeId, userId)
+		return L.Error("promo_code_exhausted")
+	}
+
+	return nil
+}
+
+// planPriceFor returns the effective price for a plan/period after
+// validating and applying an optional promo code, without redeeming it; see
+// PlanCheckout, which calls this and defers the actual redemption until the
+// checkout completes.
+func planPriceFor(planId int, period string, promoCode string, userId int) (int64, error) {
+	plan := planGet(planId)
+	if plan == nil {
+		return 0, L.Error("invalid_plan")
+	}
+	plan.LoadPrices()
+
+	price, ok := plan.Prices[period]
+	if !ok {
+		return 0, L.Error("plan_period_unsupported")
+	}
+
+	if promoCode == "" {
+		return price, nil
+	}
+
+	promo := promoCodeGet(promoCode)
+	if promo == nil || promo.Revoked {
+		return 0, L.Error("promo_code_invalid")
+	}
+	if promo.PlanId != 0 && promo.PlanId != planId {
+		return 0, L.Error("promo_code_invalid")
+	}
+	if !promo.ExpireTime.IsZero() && time.Now().After(promo.ExpireTime) {
+		return 0, L.Error("promo_code_expired")
+	}
+	if promo.RemainingUses <= 0 {
+		return 0, L.Error("promo_code_exhausted")
+	}
+
+	var redeemed int
+	db.QueryRow("SELECT COUNT(*) FROM promo_code_redemptions WHERE promo_code_id = ? AND user_id = ?", promo.Id, userId).Scan(&redeemed)
+	if redeemed > 0 {
+		return 0, L.Error("promo_code_already_used")
+	}
+
+	return promoApplyDiscount(price, promo), nil
+}
+
+// PlanCheckout resolves planId/period/promoCode to an effective price via
+// planPriceFor and hands that price to the payment interface's own Payment
+// flow; billing handlers should call this rather than computing a raw
+// amount themselves and calling PaymentInterface.Payment directly, so that
+// plan pricing and promo codes stay in effect. BitcoinRpcPayment.Payment
+// does not use the price it is handed: it credits whatever BTC arrives, so
+// the computed price does not change what a Bitcoin checkout charges.
+//
+// The promo code is recorded, not redeemed, before Payment runs: for
+// Stripe and BitcoinRpcPayment confirmation happens later via an
+// asynchronous webhook or poll, at which point planCheckoutComplete
+// performs the actual redemption. Each call adds its own pending_checkouts
+// row rather than replacing a prior one, so starting a second checkout
+// before an earlier one confirms can't make its promo code unredeemable.
+func PlanCheckout(pi PaymentInterface, w http.ResponseWriter, r *http.Request, userId int, planId int, period string, promoCode string) error {
+	price, err := planPriceFor(planId, period, promoCode, userId)
+	if err != nil {
+		return err
+	}
+
+	result := db.Exec(
+		"INSERT INTO pending_checkouts (user_id, promo_code, time) VALUES (?, ?, NOW())",
+		userId, promoCode,
+	)
+	checkoutId := result.LastInsertId()
+
+	if err := pi.Payment(w, r, userId, price); err != nil {
+		db.Exec("DELETE FROM pending_checkouts WHERE id = ?", checkoutId)
+		return err
+	}
+	return nil
+}
+
+// planCheckoutComplete redeems the promo code recorded by the oldest
+// pending checkout PlanCheckout started for userId, if any, and discards
+// that checkout. Payment backends call this once they've actually credited
+// the user's balance, since that's the point at which a checkout is
+// considered to have gone through; see StripePayment.Callback and
+// BitcoinRpcPayment.poll.
+//
+// Neither backend's confirmation identifies which specific checkout it
+// corresponds to, so checkouts are matched oldest-first: if a user starts
+// several before any of them confirm, they're paired with completions in
+// the order they were started rather than the order they're actually paid.
+func planCheckoutComplete(userId int) {
+	var checkoutId int
+	var promoCode string
+	err := db.QueryRow(
+		"SELECT id, promo_code FROM pending_checkouts WHERE user_id = ? ORDER BY id ASC LIMIT 1",
+		userId,
+	).Scan(&checkoutId, &promoCode)
+	if err != nil {
+		return
+	}
+	db.Exec("DELETE FROM pending_checkouts WHERE id = ?", checkoutId)
+	if promoCode == "" {
+		return
+	}
+
+	promo := promoCodeGet(promoCode)
+	if promo == nil {
+		return
+	}
+	if err := promoCodeRedeem(promo.Id, userId); err != nil {
+		log.Printf("plan: failed to redeem promo code %s for user %d: %s", promoCode, userId, err.Error())
+	}
+}
+
+// promoApplyDiscount applies a promo code's percentage and/or fixed
+// discount to a price, floored at zero.
+func promoApplyDiscount(price int64, promo *PromoCode) int64 {
+	discounted := price
+	if promo.PercentOff > 0 {
+		discounted -= price * int64(promo.PercentOff) / 100
+	}
+	if promo.AmountOff > 0 {
+		discounted -= promo.AmountOff
+	}
+	if discounted < 0 {
+		discounted = 0
+	}
+	return discounted
+}
@@ -0,0 +1,31 @@
+package lobster
+
+import "testing"
+
+func TestPromoApplyDiscountPercentOff(t *testing.T) {
+	promo := &PromoCode{PercentOff: 25}
+	if got := promoApplyDiscount(2000, promo); got != 1500 {
+		t.Fatalf("expected 25%% off 2000 to be 1500, got %d", got)
+	}
+}
+
+func TestPromoApplyDiscountAmountOff(t *testing.T) {
+	promo := &PromoCode{AmountOff: 500}
+	if got := promoApplyDiscount(2000, promo); got != 1500 {
+		t.Fatalf("expected 500 off 2000 to be 1500, got %d", got)
+	}
+}
+
+func TestPromoApplyDiscountCombinedAndFloored(t *testing.T) {
+	promo := &PromoCode{PercentOff: 50, AmountOff: 5000}
+	if got := promoApplyDiscount(2000, promo); got != 0 {
+		t.Fatalf("expected a discount larger than the price to floor at 0, got %d", got)
+	}
+}
+
+func TestPromoApplyDiscountNoneConfigured(t *testing.T) {
+	promo := &PromoCode{}
+	if got := promoApplyDiscount(2000, promo); got != 2000 {
+		t.Fatalf("expected no discount to leave the price unchanged, got %d", got)
+	}
+}
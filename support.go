@@ -65,7 +65,7 @@ func ticketDetails(db *Database, userId int, ticketId int, staff bool) *Ticket {
 	return ticket
 }
 
-func ticketOpen(db *Database, userId int, name string, message string, staff bool) (int, error) {
+func ticketOpen(db *Database, userId int, name string, message string, ip string, staff bool) (int, error) {
 	if name == "" || message == "" {
 		return 0, L.Error("subject_message_empty")
 	} else if len(message) > 16384 {
@@ -77,6 +77,8 @@ func ticketOpen(db *Database, userId int, name string, message string, staff boo
 		return 0, L.Errorf("ticket_for_support", cfg.Default.AdminEmail)
 	}
 
+	suspicious := !staff && (abuseTest("email", user.Email) || abuseTest("ip", ip))
+
 	result := db.Exec("INSERT INTO tickets (user_id, name, status, modify_time) VALUES (?, ?, 'open', NOW())", userId, name)
 	ticketId, err := result.LastInsertId()
 	if err != nil {
@@ -85,18 +87,34 @@ func ticketOpen(db *Database, userId int, name string, message string, staff boo
 	db.Exec("INSERT INTO ticket_messages (ticket_id, staff, message) VALUES (?, ?, ?)", ticketId, staff, message)
 	if staff {
 		mailWrap(db, userId, "ticketOpen", TicketUpdateEmail{Id: int(ticketId), Subject: name, Message: message}, false)
+	} else if suspicious {
+		// flag for staff review instead of the usual auto-reply; the ticket
+		// is left in the 'open' state so it surfaces in the staff queue
+		log.Printf("Ticket %d from user %d flagged as suspicious by abuse guard", ticketId, userId)
 	} else {
 		mailWrap(db, -1, "ticketOpen", TicketUpdateEmail{Id: int(ticketId), Subject: name, Message: message}, false)
-		go func() {
-			time.Sleep(20 * time.Second)
-			ticketReply(db, userId, int(ticketId), "We have resolved this issue. Have a good day.\n\nRegards,\nLobster Staff", true)
-		}()
+		ticketWorkflowSchedule(int(ticketId), ticketStateAutoReply, "auto_resolved", time.Now().Add(20*time.Second))
+		ticketWorkflowSchedule(int(ticketId), ticketStateEscalate, "", time.Now().Add(24*time.Hour))
 	}
 	log.Printf("Ticket opened for user %d: %s", userId, name)
 	return int(ticketId), nil
 }
 
 func ticketReply(db *Database, userId int, ticketId int, message string, staff bool) error {
+	return ticketReplyImpl(db, userId, ticketId, message, staff, false)
+}
+
+// ticketAutoReply posts the auto-responder's canned acknowledgement.
+// Unlike a genuine staff reply, it must not cancel a pending SLA
+// escalation: a bot posting a canned message isn't a real resolution, and
+// it fires at the same +20s mark on every ticket that also scheduled a
+// +24h escalation, so treating it like a normal reply would silently
+// cancel every escalation before it could ever fire.
+func ticketAutoReply(db *Database, userId int, ticketId int, message string) error {
+	return ticketReplyImpl(db, userId, ticketId, message, true, true)
+}
+
+func ticketReplyImpl(db *Database, userId int, ticketId int, message string, staff bool, preserveEscalate bool) error {
 	if message == "" {
 		return L.Error("message_empty")
 	}
@@ -109,16 +127,20 @@ func ticketReply(db *Database, userId int, ticketId int, message string, staff b
 	db.Exec("INSERT INTO ticket_messages (ticket_id, staff, message) VALUES (?, ?, ?)", ticketId, staff, message)
 
 	// update ticket status
+	if preserveEscalate {
+		ticketWorkflowCancelExceptEscalate(ticketId)
+	} else {
+		ticketWorkflowCancel(ticketId)
+	}
 	newStatus := "open"
 	if staff {
 		newStatus = "answered"
 		mailWrap(db, userId, "ticketReply", TicketUpdateEmail{Id: ticketId, Subject: ticket.Name, Message: message}, false)
+		ticketWorkflowSchedule(ticketId, ticketStateAutoClose, "", time.Now().Add(7*24*time.Hour))
 	} else {
 		mailWrap(db, -1, "ticketReply", TicketUpdateEmail{Id: ticketId, Subject: ticket.Name, Message: message}, false)
-		go func() {
-			time.Sleep(20 * time.Second)
-			ticketReply(db, userId, int(ticketId), "We have resolved this issue. Have a good day.\n\nRegards,\nLobster Staff", true)
-		}()
+		ticketWorkflowSchedule(ticketId, ticketStateAutoReply, "auto_resolved", time.Now().Add(20*time.Second))
+		ticketWorkflowSchedule(ticketId, ticketStateEscalate, "", time.Now().Add(24*time.Hour))
 	}
 	db.Exec("UPDATE tickets SET modify_time = NOW(), status = ? WHERE id = ?", newStatus, ticketId)
 	log.Printf("Ticket reply for user %d on ticket #%d %s", userId, ticketId, ticket.Name)
@@ -128,3 +150,27 @@ func ticketReply(db *Database, userId int, ticketId int, message string, staff b
 func ticketClose(db *Database, userId int, ticketId int) {
 	db.Exec("UPDATE tickets SET modify_time = NOW(), status = 'closed' WHERE id = ? AND user_id = ?", ticketId, userId)
 }
+
+// ticketCloseAbusive lets staff close a ticket while also teaching the
+// abuse guard about the reporting user's email and IP, so that a later
+// ticket from the same email or IP is flagged for review instead of
+// getting the usual auto-reply. This is the guard's only signal producer
+// in this tree today; signup will need to call abuseSignal as well once
+// it exists.
+func ticketCloseAbusive(db *Database, ticketId int, ip string) {
+	ticket := ticketDetails(db, 0, ticketId, true)
+	if ticket == nil {
+		return
+	}
+
+	user := userDetails(db, ticket.UserId)
+	if user != nil {
+		abuseSignal("email", user.Email)
+	}
+	if ip != "" {
+		abuseSignal("ip", ip)
+	}
+
+	db.Exec("UPDATE tickets SET modify_time = NOW(), status = 'closed' WHERE id = ?", ticketId)
+	log.Printf("Ticket %d closed as abusive by staff", ticketId)
+}
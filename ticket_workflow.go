@@ -0,0 +1,194 @@
+package lobster
+
+import "log"
+import "time"
+
+// Migration: replaces the previous time.Sleep goroutine (which lost all
+// state across a restart) with durable scheduling plus admin-configurable
+// canned responses.
+//
+//   CREATE TABLE ticket_workflow (
+//       id INT NOT NULL AUTO_INCREMENT,
+//       ticket_id INT NOT NULL,
+//       state VARCHAR(64) NOT NULL,
+//       next_action_time DATETIME NOT NULL,
+//       template VARCHAR(64) NOT NULL,
+//       PRIMARY KEY (id),
+//       KEY (next_action_time)
+//   );
+//   CREATE TABLE ticket_canned_responses (
+//       id INT NOT NULL AUTO_INCREMENT,
+//       name VARCHAR(64) NOT NULL,
+//       template TEXT NOT NULL,
+//       PRIMARY KEY (id)
+//   );
+
+const ticketWorkflowScanInterval = 30 * time.Second
+
+// ticketStateAutoReply/ticketStateEscalate/ticketStateAutoClose name the
+// workflow states; ticketStateAutoReply replaces the previous hardcoded
+// 20-second auto-reply goroutine with a durable scheduled action.
+const (
+	ticketStateAutoReply = "auto_reply"
+	ticketStateEscalate = "escalate"
+	ticketStateAutoClose = "auto_close"
+)
+
+// TicketAutoResponder lets operators plug in rule-based ticket handling
+// (keyword routing, SLA escalation, auto-close on idle) instead of the
+// single hardcoded reply the workflow previously always sent. Handlers run
+// in registration order against every ticket with a due action; the first
+// one that reports it applied wins.
+type TicketAutoResponder interface {
+	Name() string
+	Handle(db *Database, ticket *Ticket, state string) (applied bool)
+}
+
+var ticketAutoResponders []TicketAutoResponder
+
+func RegisterTicketAutoResponder(responder TicketAutoResponder) {
+	ticketAutoResponders = append(ticketAutoResponders, responder)
+}
+
+// TicketWorkflowInit registers the built-in responders and starts the
+// background scanner. It must be called once during app startup, otherwise
+// rows inserted by ticketWorkflowSchedule are never processed.
+func TicketWorkflowInit() {
+	RegisterTicketAutoResponder(&defaultTicketResponder{})
+	go ticketWorkflowRun()
+}
+
+// ticketWorkflowSchedule records a due action durably so that a process
+// restart before next_action_time doesn't lose it, unlike the goroutine it
+// replaces.
+func ticketWorkflowSchedule(ticketId int, state string, template string, at time.Time) {
+	db.Exec(
+		"INSERT INTO ticket_workflow (ticket_id, state, next_action_time, template) VALUES (?, ?, ?, ?)",
+		ticketId, state, at, template,
+	)
+}
+
+func ticketWorkflowCancel(ticketId int) {
+	db.Exec("DELETE FROM ticket_workflow WHERE ticket_id = ?", ticketId)
+}
+
+// ticketWorkflowCancelExceptEscalate cancels pending actions for the
+// ticket other than a scheduled SLA escalation; see ticketAutoReply for why
+// the escalation needs to survive it.
+func ticketWorkflowCancelExceptEscalate(ticketId int) {
+	db.Exec("DELETE FROM ticket_workflow WHERE ticket_id = ? AND state != ?", ticketId, ticketStateEscalate)
+}
+
+func ticketWorkflowRun() {
+	for {
+		time.Sleep(ticketWorkflowScanInterval)
+		ticketWorkflowScan()
+	}
+}
+
+func ticketWorkflowScan() {
+	type due struct {
+		id int
+		ticketId int
+		state string
+		template string
+	}
+
+	rows := db.Query("SELECT id, ticket_id, state, template FROM ticket_workflow WHERE next_action_time <= NOW()")
+	var actions []due
+	for rows.Next() {
+		var a due
+		rows.Scan(&a.id, &a.ticketId, &a.state, &a.template)
+		actions = append(actions, a)
+	}
+	rows.Close()
+
+	for _, a := range actions {
+		db.Exec("DELETE FROM ticket_workflow WHERE id = ?", a.id)
+
+		ticket := ticketDetails(db, 0, a.ticketId, true)
+		if ticket == nil {
+			continue
+		}
+
+		applied := false
+		for _, responder := range ticketAutoResponders {
+			if responder.Handle(db, ticket, a.state) {
+				applied = true
+				break
+			}
+		}
+		if !applied {
+			log.Printf("ticket workflow: no responder applied to ticket %d in state %s", a.ticketId, a.state)
+		}
+	}
+}
+
+// defaultTicketResponder posts a canned resolution reply, escalates to the
+// admin when a ticket has gone without a staff reply for the SLA window, and
+// auto-closes a ticket left idle after a staff reply, as a normal responder
+// rather than hardcoded control flow.
+type defaultTicketResponder struct{}
+
+func (this *defaultTicketResponder) Name() string {
+	return "default"
+}
+
+func (this *defaultTicketResponder) Handle(db *Database, ticket *Ticket, state string) bool {
+	switch state {
+	case ticketStateAutoReply:
+		template := ticketCannedResponseGetByName("auto_resolved")
+		if template == "" {
+			template = "We have resolved this issue. Have a good day.\n\nRegards,\nLobster Staff"
+		}
+		ticketAutoReply(db, ticket.UserId, ticket.Id, template)
+		return true
+	case ticketStateEscalate:
+		mailWrap(db, -1, "ticketEscalate", TicketUpdateEmail{Id: ticket.Id, Subject: ticket.Name, Message: "This ticket has not been answered within the SLA window."}, false)
+		return true
+	case ticketStateAutoClose:
+		ticketClose(db, ticket.UserId, ticket.Id)
+		return true
+	default:
+		return false
+	}
+}
+
+// ticketCannedResponse holds an admin-configurable reply template, so that
+// operators can edit canned responses without a code deploy.
+type ticketCannedResponse struct {
+	Id int
+	Name string
+	Template string
+}
+
+func ticketCannedResponseList() []*ticketCannedResponse {
+	rows := db.Query("SELECT id, name, template FROM ticket_canned_responses ORDER BY name")
+	defer rows.Close()
+	responses := make([]*ticketCannedResponse, 0)
+	for rows.Next() {
+		r := &ticketCannedResponse{}
+		rows.Scan(&r.Id, &r.Name, &r.Template)
+		responses = append(responses, r)
+	}
+	return responses
+}
+
+func ticketCannedResponseGetByName(name string) string {
+	var template string
+	db.QueryRow("SELECT template FROM ticket_canned_responses WHERE name = ?", name).Scan(&template)
+	return template
+}
+
+func ticketCannedResponseCreate(name string, template string) int {
+	result := db.Exec("INSERT INTO ticket_canned_responses (name, template) VALUES (?, ?)", name, template)
+	return result.LastInsertId()
+}
+
+func ticketCannedResponseUpdate(id int, name string, template string) {
+	db.Exec("UPDATE ticket_canned_responses SET name = ?, template = ? WHERE id = ?", name, template, id)
+}
+
+func ticketCannedResponseDelete(id int) {
+	db.Exec("DELETE FROM ticket_canned_responses WHERE id = ?", id)
+}